@@ -12,14 +12,59 @@ import (
 
 var ErrTooLarge = errors.New("bffer: too large")
 
+// readOp tracks what the last read-side call did, so UnreadByte can report
+// bytes.Buffer's usual error instead of silently rewinding past a Write or
+// an empty Read.
+type readOp int8
+
+const (
+	opInvalid readOp = -1 // no operation, or one that can't be undone
+	opRead    readOp = 1  // the last operation read at least one byte
+)
+
 type Buffer struct {
 	Buf       []byte   // Buffer contents.
 	off       int      // read at &buf[off], write at &buf[len(off)]
+	lastRead  readOp   // last read operation, for UnreadByte
 	bootstrap [64]byte // memory to hold first slice; helps small Buffers (Printf) avoid allocation.
+
+	// strikes and prevCap let BytePool.Put notice a Buffer whose
+	// utilization has collapsed (e.g. after a one-off large request) and
+	// stop pinning its oversized backing array; see strike in bytepool.go.
+	strikes int
+	prevCap int
+
+	// reserved is the number of bytes BytePool.acquire charged against
+	// maxBytesInUse when this Buffer was handed out by Get; Put releases
+	// exactly this many bytes back, regardless of how much the Buffer grew
+	// in the meantime. Zero for a Buffer that didn't come from a Get (or
+	// came from a BytePool with no maxBytesInUse set).
+	reserved int64
+
+	// used is the high-water mark of len(Buf), updated in grow. Unlike off,
+	// it never moves backwards on a Read/Next/WriteTo, so it reflects how
+	// much of the Buffer a caller actually wrote regardless of whether (or
+	// how) they later read it back; see record and strike in bytepool.go.
+	used int
 }
 
+// NewBuffer returns an empty Buffer with size bytes of pre-allocated
+// capacity.
 func NewBuffer(size int) *Buffer {
-	return &Buffer{Buf: make([]byte, size)}
+	return &Buffer{Buf: make([]byte, 0, size)}
+}
+
+// ResetBuf discards the Buffer's current contents and makes buf its backing
+// array, with no bytes yet read or written. It lets a caller hand the
+// Buffer externally-owned scratch space (e.g. a []byte from a different
+// pool) without an allocation.
+func (b *Buffer) ResetBuf(buf []byte) {
+	b.Buf = buf[:0]
+	b.off = 0
+	b.lastRead = opInvalid
+	b.strikes = 0
+	b.prevCap = 0
+	b.used = 0
 }
 
 func (b *Buffer) Write(p []byte) (n int, err error) {
@@ -27,6 +72,123 @@ func (b *Buffer) Write(p []byte) (n int, err error) {
 	return copy(b.Buf[m:], p), nil
 }
 
+// WriteString appends s to the Buffer, growing it as needed.
+func (b *Buffer) WriteString(s string) (n int, err error) {
+	m := b.grow(len(s))
+	return copy(b.Buf[m:], s), nil
+}
+
+// WriteByte appends c to the Buffer, growing it as needed.
+func (b *Buffer) WriteByte(c byte) error {
+	m := b.grow(1)
+	b.Buf[m] = c
+	return nil
+}
+
+// minRead is the minimum slice size passed to a ReadFrom's io.Reader.Read
+// call, matching bytes.Buffer.
+const minRead = 512
+
+// ReadFrom reads from r until EOF, growing the Buffer as needed.
+func (b *Buffer) ReadFrom(r io.Reader) (n int64, err error) {
+	b.lastRead = opInvalid
+	for {
+		used := b.used
+		i := b.grow(minRead)
+		b.Buf = b.Buf[:i]
+		m, e := r.Read(b.Buf[i:cap(b.Buf)])
+		if m < 0 {
+			panic("bytepool: Buffer.ReadFrom: reader returned negative count from Read")
+		}
+		b.Buf = b.Buf[:i+m]
+		// grow counted all minRead bytes as written; count only what Read filled.
+		b.used = used
+		if len(b.Buf) > b.used {
+			b.used = len(b.Buf)
+		}
+		n += int64(m)
+		if e == io.EOF {
+			return n, nil
+		}
+		if e != nil {
+			return n, e
+		}
+	}
+}
+
+// Read reads the next len(p) unread bytes from the Buffer into p. It
+// returns io.EOF once the Buffer is empty.
+func (b *Buffer) Read(p []byte) (n int, err error) {
+	b.lastRead = opInvalid
+	if b.off >= len(b.Buf) {
+		b.Reset()
+		if len(p) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+	n = copy(p, b.Buf[b.off:])
+	b.off += n
+	if n > 0 {
+		b.lastRead = opRead
+	}
+	return n, nil
+}
+
+// ReadByte reads and returns the next unread byte from the Buffer.
+func (b *Buffer) ReadByte() (byte, error) {
+	b.lastRead = opInvalid
+	if b.off >= len(b.Buf) {
+		b.Reset()
+		return 0, io.EOF
+	}
+	c := b.Buf[b.off]
+	b.off++
+	b.lastRead = opRead
+	return c, nil
+}
+
+// UnreadByte unreads the last byte returned by a successful ReadByte (or
+// the last byte of a successful Read or a non-empty Next). It returns an
+// error if the most recent read-side call wasn't one of those.
+func (b *Buffer) UnreadByte() error {
+	if b.lastRead == opInvalid {
+		return errors.New("bytepool: Buffer.UnreadByte: previous operation was not a successful read")
+	}
+	b.lastRead = opInvalid
+	if b.off > 0 {
+		b.off--
+	}
+	return nil
+}
+
+// Next returns a slice of the next n unread bytes, advancing past them as
+// if they'd been returned by Read. The slice aliases the Buffer's contents
+// and is only valid until the next read or write.
+func (b *Buffer) Next(n int) []byte {
+	b.lastRead = opInvalid
+	if m := b.Len(); n > m {
+		n = m
+	}
+	data := b.Buf[b.off : b.off+n]
+	b.off += n
+	if n > 0 {
+		b.lastRead = opRead
+	}
+	return data
+}
+
+// Bytes returns a slice of the Buffer's unread contents. It aliases the
+// Buffer's backing array, so it's only valid until the next read or write.
+func (b *Buffer) Bytes() []byte {
+	return b.Buf[b.off:]
+}
+
+// String returns the Buffer's unread contents as a string.
+func (b *Buffer) String() string {
+	return string(b.Buf[b.off:])
+}
+
 func (b *Buffer) WriteTo(w io.Writer) (n int64, err error) {
 	if b.off < len(b.Buf) {
 		nBytes := b.Len()
@@ -61,6 +223,7 @@ func (b *Buffer) Truncate(n int) {
 
 func (b *Buffer) Reset() {
 	b.Truncate(0)
+	b.lastRead = opInvalid
 }
 
 func (b *Buffer) Len() int {
@@ -68,6 +231,7 @@ func (b *Buffer) Len() int {
 }
 
 func (b *Buffer) grow(n int) int {
+	b.lastRead = opInvalid
 	m := b.Len()
 	// If Buffer is empty, reset to recover space.
 	if m == 0 && b.off != 0 {
@@ -93,6 +257,9 @@ func (b *Buffer) grow(n int) int {
 		b.off = 0
 	}
 	b.Buf = b.Buf[0 : b.off+m+n]
+	if len(b.Buf) > b.used {
+		b.used = len(b.Buf)
+	}
 	return b.off + m
 }
 
@@ -0,0 +1,95 @@
+// Copyright (c) 2015 SermoDigital, LLC.
+
+package bytepool
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// TestBytePoolPutResetsBuffer guards against a Buffer coming back out of
+// Get still holding the previous owner's bytes (or, for a freshly
+// allocated one, NUL bytes): Put must hand the class pool an empty
+// Buffer, not one merely truncated to its full capacity.
+func TestBytePoolPutResetsBuffer(t *testing.T) {
+	var bp BytePool
+	bp.Init(1<<20, 0)
+
+	b := bp.Get()
+	if n := b.Len(); n != 0 {
+		t.Fatalf("fresh Get: Len() = %d, want 0 (contents: %q)", n, b.Bytes())
+	}
+	if _, err := b.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	bp.Put(b)
+
+	b2 := bp.Get()
+	if n := b2.Len(); n != 0 {
+		t.Fatalf("Get after Put: Len() = %d, want 0 (stale contents: %q)", n, b2.Bytes())
+	}
+
+	if _, err := b2.Write([]byte("hi")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if got := b2.Bytes(); !bytes.Equal(got, []byte("hi")) {
+		t.Fatalf("Bytes() = %q, want %q", got, "hi")
+	}
+
+	got := make([]byte, 2)
+	n, err := b2.Read(got)
+	if err != nil || n != 2 || string(got) != "hi" {
+		t.Fatalf("Read() = (%q, %d, %v), want (\"hi\", 2, nil)", got[:n], n, err)
+	}
+}
+
+func TestBufferReadWriteRoundTrip(t *testing.T) {
+	b := NewBuffer(64)
+	if n := b.Len(); n != 0 {
+		t.Fatalf("NewBuffer: Len() = %d, want 0", n)
+	}
+
+	if _, err := b.WriteString("hello "); err != nil {
+		t.Fatalf("WriteString: %v", err)
+	}
+	if err := b.WriteByte('w'); err != nil {
+		t.Fatalf("WriteByte: %v", err)
+	}
+	if _, err := b.Write([]byte("orld")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	if got, want := b.String(), "hello world"; got != want {
+		t.Fatalf("String() = %q, want %q", got, want)
+	}
+
+	c, err := b.ReadByte()
+	if err != nil || c != 'h' {
+		t.Fatalf("ReadByte() = (%q, %v), want ('h', nil)", c, err)
+	}
+	if err := b.UnreadByte(); err != nil {
+		t.Fatalf("UnreadByte: %v", err)
+	}
+	if err := b.UnreadByte(); err == nil {
+		t.Fatal("second UnreadByte: got nil error, want non-nil")
+	}
+
+	next := b.Next(5)
+	if string(next) != "hello" {
+		t.Fatalf("Next(5) = %q, want %q", next, "hello")
+	}
+
+	rest := make([]byte, 64)
+	n, err := b.Read(rest)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if got, want := string(rest[:n]), " world"; got != want {
+		t.Fatalf("Read() = %q, want %q", got, want)
+	}
+
+	if _, err := b.Read(rest); err != io.EOF {
+		t.Fatalf("Read at EOF: got err %v, want io.EOF", err)
+	}
+}
@@ -4,152 +4,424 @@
 package bytepool
 
 import (
+	"context"
 	"math"
 	"sync"
-	"time"
-
-	"github.com/SermoDigital/golibs/ewma"
+	"sync/atomic"
 )
 
-type pool struct {
-	list []*Buffer
-	mu   sync.Mutex
-}
+// minPoolClass is the smallest power-of-2 size class a BytePool will ever
+// hand out, matching go-buffer-pool's floor: anything smaller isn't worth
+// the sync.Pool bookkeeping.
+const minPoolClass = 6 // 1 << 6 == 64
 
-type BytePool struct {
-	list_of_pools []pool
-	drainTicker   *time.Ticker
-	maxSize       int
-	*sync.Mutex
-}
+// defaultCalibrateCallsThreshold is how many Puts accumulate between
+// recalibrations of defaultSize/maxCachedSize, borrowed from
+// valyala/bytebufferpool.
+const defaultCalibrateCallsThreshold = 42000
 
-var (
-	avg    *ewma.Ewma
-	stdOff float64
+// Percentiles used when recomputing the calibrated sizes: defaultSize is
+// the smallest class covering defaultPercentile of recent Puts, and
+// maxCachedSize is the smallest class covering maxCachedPercentile.
+const (
+	defaultPercentile   = 95
+	maxCachedPercentile = 99
 )
 
-// Init initializes a BytePool structure. The BytePool starts draining
-// regularly if drainPeriod is non zero. MaxSize specifies the maximum
-// length of a Buffer that should be cached (rounded to the next power of 2).
-func (tp *BytePool) Init(drainPeriod, ewmaTime time.Duration, maxSize uint32) {
-	avg = ewma.NewEwma(ewmaTime)
-	stdOff = 1.5
+type BytePool struct {
+	list_of_pools []sync.Pool
+	maxSize       int // absolute ceiling set by Init; never cache above this
+
+	// calls is a histogram, indexed by size class, of how many bytes were
+	// actually used (el.used, the write high-water mark) across recent
+	// Puts. It's read and reset only from inside calibrate, which is
+	// guarded by calibrating so the histogram is never summed mid-update,
+	// but individual buckets are incremented lock-free from Put.
+	calls       []uint64
+	callsCount  uint64 // atomic: Puts since the last calibration
+	calibrating int32  // atomic: CAS-guarded so only one calibration runs at a time
+
+	calibrateCallsThreshold uint64 // atomic
+
+	defaultSize   uint64 // atomic: class Get uses absent a better signal
+	maxCachedSize uint64 // atomic: largest class Put will still cache; zero means no calibrated limit
+
+	// maxBytesInUse, when non-zero, caps the total bytes Get has handed out
+	// and not yet gotten back via Put. Get blocks on mu/cond until Put
+	// frees enough room, giving callers a back-pressure knob instead of
+	// letting a burst of large requests run the process out of memory.
+	maxBytesInUse int64
+	inUse         int64 // atomic; acquire checks and adds to it under mu while maxBytesInUse > 0
+	waiters       int64 // atomic
 
+	mu   sync.Mutex
+	cond *sync.Cond
+}
+
+// Init initializes a BytePool structure. MaxSize specifies the maximum
+// length of a Buffer that should be cached (rounded to the next power of 2).
+// MaxBytesInUse, if non-zero, caps the total bytes outstanding from Get that
+// haven't yet been returned via Put; once the cap is hit, Get blocks until
+// room frees up.
+func (tp *BytePool) Init(maxSize uint32, maxBytesInUse int64) {
 	maxSizeLog := log2Ceil(maxSize)
+	if maxSizeLog < minPoolClass {
+		maxSizeLog = minPoolClass
+	}
 	tp.maxSize = (1 << maxSizeLog) - 1
 	if tp.maxSize > math.MaxUint32 {
 		tp.maxSize = math.MaxUint32
 	}
-	tp.list_of_pools = make([]pool, maxSizeLog+1)
-	if drainPeriod > 0 {
-		tp.drainTicker = time.NewTicker(drainPeriod)
-		go func() {
-			for _ = range tp.drainTicker.C {
-				tp.Drain()
-				tp.UpdateMaxSize(int(avg.Current + stdOff*avg.StdDev))
-			}
-		}()
+
+	tp.list_of_pools = make([]sync.Pool, maxSizeLog+1)
+	for o := minPoolClass; o <= int(maxSizeLog); o++ {
+		size := 1 << uint(o)
+		tp.list_of_pools[o].New = func() interface{} {
+			return NewBuffer(size)
+		}
+	}
+
+	tp.calls = make([]uint64, maxSizeLog+1)
+	atomic.StoreUint64(&tp.callsCount, 0)
+	atomic.StoreInt32(&tp.calibrating, 0)
+	atomic.StoreUint64(&tp.calibrateCallsThreshold, defaultCalibrateCallsThreshold)
+	atomic.StoreUint64(&tp.defaultSize, 1<<minPoolClass)
+	atomic.StoreUint64(&tp.maxCachedSize, 0)
+
+	tp.maxBytesInUse = maxBytesInUse
+	atomic.StoreInt64(&tp.inUse, 0)
+	atomic.StoreInt64(&tp.waiters, 0)
+	tp.cond = sync.NewCond(&tp.mu)
+}
+
+// SetCalibrateInterval sets how many Puts accumulate before the calibrated
+// default/max-cached sizes are recomputed. Init sets this to 42000.
+func (tp *BytePool) SetCalibrateInterval(n uint64) {
+	atomic.StoreUint64(&tp.calibrateCallsThreshold, n)
+}
+
+// Stats reports BytePool's calibrated sizes and its memory back-pressure
+// state, for observability.
+type Stats struct {
+	// DefaultSize is the class Get returns absent any other signal.
+	DefaultSize int
+	// MaxCachedSize is the largest class Put will still cache; buffers
+	// above it are dropped for GC. Zero means no calibrated limit yet, so
+	// only Init's maxSize applies.
+	MaxCachedSize int
+	// InUse is the number of bytes currently held by callers that have
+	// called Get but not yet called Put.
+	InUse int64
+	// Allocated is the configured ceiling (Init's maxBytesInUse); zero
+	// means unbounded.
+	Allocated int64
+	// Waiters is the number of goroutines currently blocked in Get or
+	// GetContext waiting for room under Allocated.
+	Waiters int64
+}
+
+// Stats returns the most recently calibrated sizes and the pool's current
+// memory back-pressure state.
+func (tp *BytePool) Stats() Stats {
+	return Stats{
+		DefaultSize:   int(atomic.LoadUint64(&tp.defaultSize)),
+		MaxCachedSize: int(atomic.LoadUint64(&tp.maxCachedSize)),
+		InUse:         atomic.LoadInt64(&tp.inUse),
+		Allocated:     tp.maxBytesInUse,
+		Waiters:       atomic.LoadInt64(&tp.waiters),
 	}
-	tp.Mutex = &sync.Mutex{}
 }
 
 // Put the Buffer back in pool.
 func (tp *BytePool) Put(el *Buffer) {
+	tp.record(el.used)
+
+	tp.release(el.reserved)
+	el.reserved = 0
+
 	c := cap(el.Buf)
+	o := log2Floor(uint32(c))
 
-	if c > tp.maxSize ||
-		c < int(avg.Current-(stdOff*avg.StdDev)) ||
-		c < 1 {
+	maxCached := int(atomic.LoadUint64(&tp.maxCachedSize))
+
+	// Only cache the Buffer if it's still within the size ceiling, the
+	// calibrated max-cached size, and its capacity is an exact fit for
+	// the class it'd land in; a short fit would silently truncate the
+	// next Get's caller to less than it asked for.
+	if c < 1 || c > tp.maxSize || (maxCached > 0 && c > maxCached) ||
+		int(o) >= len(tp.list_of_pools) || o < minPoolClass || c != 1<<o {
 		return
 	}
 
-	// Update the average with the offset of the buffer. (i.e., the amount
-	// of bytes written to the buffer.)
-	avg.UpdateNow(float64(el.off))
+	if tp.strike(el, c) {
+		return
+	}
 
-	// Replace the end with the number of written bytes because of some
-	// issues where buffers would initially fill up with, say, 2KB of data,
-	// and subsequent writes would write less than 2KB. Since WriteTo writes
-	// until the end of the buffer, it'd cause old data, un-overwritten by
-	// the subsequent writes to be displayed to the screen. Theoretically
-	// we could zero out the buffers, but looping over a buffer that's
-	// could be upwards of 1MB would be expensive.
-	el.end = el.off
+	// Hand the next Get an empty Buffer, not one merely truncated to its
+	// full capacity: the latter leaves whatever the previous owner wrote
+	// (or, for a fresh NewBuffer, NUL bytes) visible to Read/Bytes/String,
+	// and makes the next Write append after that stale tail instead of
+	// overwriting from the start.
 	el.off = 0
-	el.Buf = el.Buf[:c]
-	o := log2Floor(uint32(c))
-	p := &tp.list_of_pools[o]
-	p.mu.Lock()
-	p.list = append(p.list, el)
-	p.mu.Unlock()
+	el.Buf = el.Buf[:0]
+	el.used = 0
+	tp.list_of_pools[o].Put(el)
 }
 
-// Get a Buffer from the pool.
-func (tp *BytePool) Get() *Buffer {
+// record adds used (the number of bytes actually written before Put) to the
+// calibration histogram, and triggers a recalibration once enough calls
+// have accumulated.
+func (tp *BytePool) record(used int) {
+	class := log2Ceil(uint32(used))
+	if int(class) < minPoolClass {
+		class = minPoolClass
+	}
+	if int(class) < len(tp.calls) {
+		atomic.AddUint64(&tp.calls[class], 1)
+	}
+	if atomic.AddUint64(&tp.callsCount, 1) > atomic.LoadUint64(&tp.calibrateCallsThreshold) {
+		tp.calibrate()
+	}
+}
 
-	// Grab the current average. If the average is larger than the max
-	// size we have to create a new buffer for the size.
-	size := int(avg.Current)
-	if size < 1 || size > tp.maxSize {
-		return NewBuffer(size)
+// strikeThreshold and strikeMinFraction tune strike: how many consecutive
+// under-utilized Puts a Buffer tolerates before it's dropped instead of
+// cached, and how little of its capacity a Put may use before it counts
+// against it.
+const (
+	strikeThreshold   = 4
+	strikeMinFraction = 16
+)
+
+// strike tracks a Buffer's utilization across Puts and reports whether it
+// should be dropped instead of cached. A sync.Pool has no way to shrink an
+// entry already holding a large backing array (golang/go#23199): once one
+// goes in, Get can hand it back out forever even if every later request is
+// small. Counting consecutive under-utilized Puts lets the pool walk its
+// own capacity back down after a transient spike, instead of waiting on a
+// periodic drain to nuke everything.
+func (tp *BytePool) strike(el *Buffer, c int) bool {
+	underUtilized := el.used < c/strikeMinFraction
+	shrunk := el.prevCap > 0 && c < el.prevCap/2
+	if underUtilized || shrunk {
+		el.strikes++
+	} else {
+		el.strikes = 0
 	}
+	el.prevCap = c
 
-	var x *Buffer
+	if el.strikes < strikeThreshold {
+		return false
+	}
+	el.strikes = 0
+	el.prevCap = 0
+	target := belowClass(uint32(c))
+	tp.shrinkMaxCachedTo(target)
+	tp.shrinkDefaultTo(target)
+	return true
+}
 
-	o := log2Ceil(uint32(size))
-	p := &tp.list_of_pools[o]
+// belowClass returns a ceiling strictly below c's own size class, so a
+// Put's c > maxCached check actually rejects future buffers of c's class
+// too, not just strictly larger ones. Below the smallest class there's
+// nowhere further to go, so it returns a value beneath every real class
+// (1<<minPoolClass - 1), which rejects everything the pool could ever hand
+// out.
+func belowClass(c uint32) uint32 {
+	class := log2Floor(c)
+	if class > minPoolClass {
+		return 1 << (class - 1)
+	}
+	return 1<<minPoolClass - 1
+}
 
-	p.mu.Lock()
-	if n := len(p.list); n > 0 {
-		x = p.list[n-1]
-		p.list[n-1] = nil
-		p.list = p.list[:n-1]
+// shrinkMaxCachedTo lowers the calibrated max-cached size to at most size,
+// so future Puts stop caching buffers as large as the one that just got
+// struck out.
+func (tp *BytePool) shrinkMaxCachedTo(size uint32) {
+	for {
+		cur := atomic.LoadUint64(&tp.maxCachedSize)
+		if cur != 0 && cur <= uint64(size) {
+			return
+		}
+		if atomic.CompareAndSwapUint64(&tp.maxCachedSize, cur, uint64(size)) {
+			return
+		}
 	}
-	p.mu.Unlock()
+}
 
-	if x != nil {
-		return x
+// shrinkDefaultTo lowers the calibrated default size to at most size, so
+// future Gets stop requesting buffers as large as the one that just got
+// struck out instead of waiting on the next histogram calibration.
+func (tp *BytePool) shrinkDefaultTo(size uint32) {
+	for {
+		cur := atomic.LoadUint64(&tp.defaultSize)
+		if cur <= uint64(size) {
+			return
+		}
+		if atomic.CompareAndSwapUint64(&tp.defaultSize, cur, uint64(size)) {
+			return
+		}
 	}
-	return NewBuffer(1 << o)
 }
 
-// Drain all items from the pool and make them availabe for garbage
-// collection.
-func (tp *BytePool) Drain() {
-	for o := 0; o < len(tp.list_of_pools); o++ {
-		p := &tp.list_of_pools[o]
-		p.mu.Lock()
-		p.list = make([]*Buffer, 0, cap(p.list)/2)
-		p.mu.Unlock()
+// calibrate recomputes defaultSize and maxCachedSize from the histogram of
+// recently observed Put sizes. It's lock-free: calibrating is a CAS-guarded
+// single-flight gate (playing the role a sync.Once would if calibration
+// only ever needed to run once), so if multiple goroutines cross the
+// threshold simultaneously only one of them does the work, and the rest
+// return immediately to let the next period's calls recalibrate instead.
+func (tp *BytePool) calibrate() {
+	if !atomic.CompareAndSwapInt32(&tp.calibrating, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&tp.calibrating, 0)
+
+	var total uint64
+	counts := make([]uint64, len(tp.calls))
+	for i := range tp.calls {
+		counts[i] = atomic.SwapUint64(&tp.calls[i], 0)
+		total += counts[i]
+	}
+	atomic.StoreUint64(&tp.callsCount, 0)
+	if total == 0 {
+		return
+	}
+
+	var running uint64
+	var haveDefault, haveMaxCached bool
+	for class := minPoolClass; class < len(counts); class++ {
+		running += counts[class]
+		pct := float64(running) / float64(total) * 100
+		if !haveDefault && pct >= defaultPercentile {
+			atomic.StoreUint64(&tp.defaultSize, uint64(1)<<uint(class))
+			haveDefault = true
+		}
+		if !haveMaxCached && pct >= maxCachedPercentile {
+			atomic.StoreUint64(&tp.maxCachedSize, uint64(1)<<uint(class))
+			haveMaxCached = true
+		}
 	}
 }
 
-// Close drains the pool and stops the drain ticker.
-func (tp *BytePool) Close() {
-	tp.Drain()
-	if tp.drainTicker != nil {
-		tp.drainTicker.Stop()
-		tp.drainTicker = nil
+// Get a Buffer from the pool. If Init was given a non-zero maxBytesInUse
+// and the pool is currently at that cap, Get blocks until a Put frees
+// enough room.
+func (tp *BytePool) Get() *Buffer {
+	b, _ := tp.get(context.Background())
+	return b
+}
+
+// GetContext is Get, but the wait for room under maxBytesInUse can be
+// cancelled via ctx; if ctx is done before room frees up, it returns
+// ctx.Err().
+func (tp *BytePool) GetContext(ctx context.Context) (*Buffer, error) {
+	return tp.get(ctx)
+}
+
+func (tp *BytePool) get(ctx context.Context) (*Buffer, error) {
+	size := int(atomic.LoadUint64(&tp.defaultSize))
+	want := int64(classSize(size, tp.maxSize))
+
+	if err := tp.acquire(ctx, want); err != nil {
+		return nil, err
+	}
+
+	var b *Buffer
+	if size < 1 || size > tp.maxSize {
+		b = NewBuffer(size)
+	} else {
+		o := log2Ceil(uint32(size))
+		if int(o) < minPoolClass {
+			o = minPoolClass
+		}
+		b = tp.list_of_pools[o].Get().(*Buffer)
 	}
+
+	// Record what was actually charged against maxBytesInUse so Put can
+	// release exactly that much, even if the caller grows b well past
+	// want in the meantime.
+	b.reserved = want
+	return b, nil
 }
 
-// Get number of entries, for debugging
-func (tp *BytePool) Entries() uint {
-	var s uint
-	for o := 0; o < len(tp.list_of_pools); o++ {
-		p := &tp.list_of_pools[o]
-		p.mu.Lock()
-		s += uint(len(p.list))
-		p.mu.Unlock()
+// classSize reports the exact capacity Get would hand out for size: size
+// itself if it falls outside the pooled range, otherwise the size class
+// it's rounded up to.
+func classSize(size, maxSize int) int {
+	if size < 1 || size > maxSize {
+		return size
 	}
-	return s
+	o := log2Ceil(uint32(size))
+	if int(o) < minPoolClass {
+		o = minPoolClass
+	}
+	return 1 << o
 }
 
-// UpdateMaxSize will update the maximum allowed size of a buffer.
-func (tp *BytePool) UpdateMaxSize(x int) {
-	tp.Lock()
-	defer tp.Unlock()
-	tp.maxSize = x
+// acquire reserves want bytes against maxBytesInUse, blocking until Put
+// frees enough room or ctx is cancelled. It's a no-op when Init was given
+// maxBytesInUse <= 0.
+func (tp *BytePool) acquire(ctx context.Context, want int64) error {
+	if tp.maxBytesInUse <= 0 {
+		atomic.AddInt64(&tp.inUse, want)
+		return nil
+	}
+
+	var stop chan struct{}
+	if done := ctx.Done(); done != nil {
+		stop = make(chan struct{})
+		go func() {
+			select {
+			case <-done:
+				tp.mu.Lock()
+				tp.cond.Broadcast()
+				tp.mu.Unlock()
+			case <-stop:
+			}
+		}()
+		defer close(stop)
+	}
+
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	for atomic.LoadInt64(&tp.inUse)+want > tp.maxBytesInUse {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		atomic.AddInt64(&tp.waiters, 1)
+		tp.cond.Wait()
+		atomic.AddInt64(&tp.waiters, -1)
+	}
+	atomic.AddInt64(&tp.inUse, want)
+	return nil
+}
+
+// release gives back c bytes reserved by a prior Get, waking any goroutine
+// blocked in acquire.
+func (tp *BytePool) release(c int64) {
+	atomic.AddInt64(&tp.inUse, -c)
+	if tp.maxBytesInUse > 0 {
+		tp.mu.Lock()
+		tp.cond.Broadcast()
+		tp.mu.Unlock()
+	}
+}
+
+// Close resets tp to its zero value so it can be GC'd.
+func (tp *BytePool) Close() {
+	tp.list_of_pools = nil
+	tp.maxSize = 0
+	tp.calls = nil
+	atomic.StoreUint64(&tp.callsCount, 0)
+	atomic.StoreInt32(&tp.calibrating, 0)
+	atomic.StoreUint64(&tp.calibrateCallsThreshold, 0)
+	atomic.StoreUint64(&tp.defaultSize, 0)
+	atomic.StoreUint64(&tp.maxCachedSize, 0)
+	tp.maxBytesInUse = 0
+	atomic.StoreInt64(&tp.inUse, 0)
+	atomic.StoreInt64(&tp.waiters, 0)
+	tp.cond = nil
 }
 
 var multiplyDeBruijnBitPosition = [...]uint{
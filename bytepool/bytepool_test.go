@@ -0,0 +1,263 @@
+// Copyright (c) 2015 Sermo Digital, LLC.
+
+package bytepool
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestBytePoolInUseSurvivesOversizedWrite guards against a Buffer that grows
+// well past the class size it was charged against maxBytesInUse at Get
+// time: Put must release exactly what was reserved, not cap(el.Buf), or
+// InUse drifts negative and the cap stops throttling anything.
+func TestBytePoolInUseSurvivesOversizedWrite(t *testing.T) {
+	var bp BytePool
+	bp.Init(1<<20, 1000)
+
+	b := bp.Get()
+	big := make([]byte, 500000)
+	if _, err := b.Write(big); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	bp.Put(b)
+
+	if inUse := bp.Stats().InUse; inUse != 0 {
+		t.Fatalf("Stats().InUse after Put = %d, want 0", inUse)
+	}
+}
+
+// TestBytePoolGetBlocksUnderCap verifies Get blocks once maxBytesInUse is
+// exhausted and unblocks as soon as a Put frees room.
+func TestBytePoolGetBlocksUnderCap(t *testing.T) {
+	var bp BytePool
+	bp.Init(1<<20, 64) // cap exactly one minimum-class Buffer
+
+	first := bp.Get()
+
+	done := make(chan *Buffer, 1)
+	go func() {
+		done <- bp.Get()
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Get returned before Put freed room")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	bp.Put(first)
+
+	select {
+	case b := <-done:
+		if b == nil {
+			t.Fatal("Get returned a nil Buffer")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Get never unblocked after Put")
+	}
+}
+
+// TestBytePoolGetContextCancel verifies GetContext returns the context's
+// error instead of blocking forever once it's cancelled.
+func TestBytePoolGetContextCancel(t *testing.T) {
+	var bp BytePool
+	bp.Init(1<<20, 64)
+
+	_ = bp.Get() // exhaust the cap
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := bp.GetContext(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("GetContext: err = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+// TestBytePoolClassSizeBucketing verifies classSize's size-class rounding:
+// requests floor up to minPoolClass, round up to the next power of two
+// within the pooled range, and pass through unrounded once they exceed
+// maxSize (the non-pooled fallback path).
+func TestBytePoolClassSizeBucketing(t *testing.T) {
+	var bp BytePool
+	bp.Init(1<<20, 0)
+
+	cases := []struct{ size, want int }{
+		{1, 1 << minPoolClass},
+		{1 << minPoolClass, 1 << minPoolClass},
+		{(1 << minPoolClass) + 1, 1 << (minPoolClass + 1)},
+		{1 << 10, 1 << 10},
+		{bp.maxSize + 1, bp.maxSize + 1},
+	}
+	for _, c := range cases {
+		if got := classSize(c.size, bp.maxSize); got != c.want {
+			t.Errorf("classSize(%d, %d) = %d, want %d", c.size, bp.maxSize, got, c.want)
+		}
+	}
+}
+
+// TestBytePoolGetPutReusesClassPool verifies Get/Put bucket a Buffer by its
+// class's own sync.Pool: a Buffer returned via Put comes back out of the
+// next same-class Get with the same capacity, not a fresh allocation sized
+// for whatever Get happened to ask for.
+func TestBytePoolGetPutReusesClassPool(t *testing.T) {
+	var bp BytePool
+	bp.Init(1<<20, 0)
+	atomic.StoreUint64(&bp.defaultSize, 1<<12)
+
+	b := bp.Get()
+	if cap(b.Buf) != 1<<12 {
+		t.Fatalf("Get: cap = %d, want %d", cap(b.Buf), 1<<12)
+	}
+	bp.Put(b)
+
+	b2 := bp.Get()
+	if cap(b2.Buf) != 1<<12 {
+		t.Fatalf("Get after Put: cap = %d, want %d", cap(b2.Buf), 1<<12)
+	}
+}
+
+// TestBytePoolOversizedBypassesPool verifies a request above maxSize falls
+// back to an unpooled NewBuffer, and that Put correctly declines to cache it
+// rather than stuffing it into a size-class pool it doesn't belong to.
+func TestBytePoolOversizedBypassesPool(t *testing.T) {
+	var bp BytePool
+	bp.Init(1<<10, 0)
+
+	want := bp.maxSize + 1
+	atomic.StoreUint64(&bp.defaultSize, uint64(want))
+
+	b := bp.Get()
+	if cap(b.Buf) != want {
+		t.Fatalf("Get: cap = %d, want %d", cap(b.Buf), want)
+	}
+	bp.Put(b) // must not panic or wedge a class pool with an oversized entry
+
+	b2 := bp.Get()
+	if cap(b2.Buf) != want {
+		t.Fatalf("Get after Put: cap = %d, want %d", cap(b2.Buf), want)
+	}
+}
+
+// TestBytePoolCalibrateIgnoresReadCursor verifies that record counts a Put's
+// real write volume, not how far off a non-consuming reader (Bytes/String)
+// left the read cursor: off stays 0 for that access pattern, but the
+// histogram must still see the buffer as fully used.
+func TestBytePoolCalibrateIgnoresReadCursor(t *testing.T) {
+	var bp BytePool
+	bp.Init(1<<20, 0)
+	bp.SetCalibrateInterval(0) // recalibrate on every Put
+
+	const class = 1 << 16
+	atomic.StoreUint64(&bp.defaultSize, class)
+
+	b := bp.Get()
+	b.Write(make([]byte, class))
+	_ = b.Bytes() // non-consuming; leaves off == 0
+	bp.Put(b)
+
+	if got := bp.Stats().DefaultSize; got < class {
+		t.Fatalf("Stats().DefaultSize = %d, want >= %d after a fully-used Put read back via Bytes()", got, class)
+	}
+}
+
+// TestBytePoolCalibratePercentiles verifies calibrate's percentile math
+// directly against a known histogram: the 95th-percentile class becomes
+// defaultSize and the 99th-percentile class becomes maxCachedSize.
+func TestBytePoolCalibratePercentiles(t *testing.T) {
+	var bp BytePool
+	bp.Init(1<<20, 0)
+	bp.SetCalibrateInterval(99)
+
+	for i := 0; i < 95; i++ {
+		bp.record(1 << 10)
+	}
+	for i := 0; i < 4; i++ {
+		bp.record(1 << 12)
+	}
+	bp.record(1 << 16) // the 100th call crosses the threshold and calibrates
+
+	stats := bp.Stats()
+	if stats.DefaultSize != 1<<10 {
+		t.Fatalf("DefaultSize = %d, want %d (95th percentile)", stats.DefaultSize, 1<<10)
+	}
+	if stats.MaxCachedSize != 1<<12 {
+		t.Fatalf("MaxCachedSize = %d, want %d (99th percentile)", stats.MaxCachedSize, 1<<12)
+	}
+}
+
+// TestBytePoolSetCalibrateIntervalDelaysRecalibration verifies
+// SetCalibrateInterval controls how many Puts accumulate before calibrate
+// runs: the calibrated sizes must not move before the interval is reached.
+func TestBytePoolSetCalibrateIntervalDelaysRecalibration(t *testing.T) {
+	var bp BytePool
+	bp.Init(1<<20, 0)
+	bp.SetCalibrateInterval(10)
+
+	for i := 0; i < 5; i++ {
+		bp.record(1 << 16)
+	}
+	if got := bp.Stats().DefaultSize; got != 1<<minPoolClass {
+		t.Fatalf("DefaultSize = %d, want unchanged %d before the interval is reached", got, 1<<minPoolClass)
+	}
+
+	for i := 0; i < 10; i++ {
+		bp.record(1 << 16)
+	}
+	if got := bp.Stats().DefaultSize; got != 1<<16 {
+		t.Fatalf("DefaultSize = %d, want %d after the interval is reached", got, 1<<16)
+	}
+}
+
+// TestBytePoolStrikeIgnoresReadCursor verifies that strike's
+// under-utilization check keys off real write volume, not how far off a
+// non-consuming reader (Bytes/String) left the read cursor: a buffer that's
+// written full and then only read back via Bytes() must not be struck out
+// even though off stays 0 across every Put.
+func TestBytePoolStrikeIgnoresReadCursor(t *testing.T) {
+	var bp BytePool
+	bp.Init(1<<20, 0)
+
+	const class = 1 << 16
+	atomic.StoreUint64(&bp.defaultSize, class)
+
+	for i := 0; i < strikeThreshold; i++ {
+		b := bp.Get()
+		b.Write(make([]byte, class))
+		_ = b.Bytes() // non-consuming; leaves off == 0
+		bp.Put(b)
+	}
+
+	if got := bp.Stats().MaxCachedSize; got != 0 && got < class {
+		t.Fatalf("Stats().MaxCachedSize = %d, want >= %d: a fully-used Buffer read back via Bytes() got struck out", got, class)
+	}
+}
+
+// TestBytePoolStrikeRejectsSameClass verifies that striking out an
+// under-utilized Buffer actually stops the pool from caching future
+// buffers of that same size class, not just strictly larger ones.
+func TestBytePoolStrikeRejectsSameClass(t *testing.T) {
+	var bp BytePool
+	bp.Init(1<<20, 0)
+
+	// Force Get/Put to target the 1<<16 class regardless of calibration.
+	const class = 1 << 16
+	atomic.StoreUint64(&bp.defaultSize, class)
+
+	for i := 0; i < strikeThreshold; i++ {
+		b := bp.Get()
+		if cap(b.Buf) != class {
+			t.Fatalf("Get: cap = %d, want %d", cap(b.Buf), class)
+		}
+		// Use almost nothing of it, so every Put counts as a strike.
+		b.Write(make([]byte, 1))
+		bp.Put(b)
+	}
+
+	if got := bp.Stats().MaxCachedSize; got >= class {
+		t.Fatalf("Stats().MaxCachedSize = %d, want < %d after striking out class %d", got, class, class)
+	}
+}